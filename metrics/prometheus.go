@@ -0,0 +1,147 @@
+// Package metrics provides a ready-made proxy_server.Observer that
+// exposes connection lifecycle and TLV traffic as Prometheus metrics.
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	proxy_server "github.com/tw4452852/proxy_server"
+)
+
+// PrometheusObserver implements proxy_server.Observer, recording
+// reconnect counts, TLV traffic volume, ping round-trip time and the
+// number of requests awaiting a drain.
+type PrometheusObserver struct {
+	reconnects      *prometheus.CounterVec
+	tlvBytes        *prometheus.HistogramVec
+	pingRTT         prometheus.Histogram
+	pendingRequests *prometheus.GaugeVec
+
+	// mu guards the fields below, since Observer methods may be called
+	// from the plugin and tunnel goroutines concurrently.
+	mu sync.Mutex
+
+	pingSentAt time.Time
+
+	// pluginGrantPending/tunnelGrantPending mark that the next
+	// WindowUpdate TLV sent on that connection is setupPlugin/
+	// setupTunnel's initial full-window advertisement rather than a
+	// replenishWindow drain, so it shouldn't move pendingRequests.
+	pluginGrantPending bool
+	tunnelGrantPending bool
+}
+
+// NewPrometheusObserver registers its metrics with prometheus.DefaultRegisterer
+// and returns an Observer ready to pass to proxy_server.WithObserver.
+func NewPrometheusObserver() *PrometheusObserver {
+	return &PrometheusObserver{
+		reconnects: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_tunnel_reconnects_total",
+			Help: "Total number of tunnel reconnect attempts.",
+		}, []string{"endpoint"}),
+		tlvBytes: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "proxy_tlv_bytes",
+			Help: "Size in bytes of TLV payloads exchanged, by connection and direction.",
+		}, []string{"connection", "direction"}),
+		pingRTT: promauto.NewHistogram(prometheus.HistogramOpts{
+			Name: "proxy_ping_rtt_seconds",
+			Help: "Observed round-trip time of tunnel keepalive pings.",
+		}),
+		pendingRequests: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_pending_requests",
+			Help: "Number of requests received but not yet drained, by connection.",
+		}, []string{"connection"}),
+	}
+}
+
+// Handler returns the promhttp handler serving these metrics.
+func (p *PrometheusObserver) Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+func (p *PrometheusObserver) OnTunnelUp(endpoint string, err error) {
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.tunnelGrantPending = true
+	p.mu.Unlock()
+}
+
+func (p *PrometheusObserver) OnTunnelDown(endpoint string, err error) {}
+
+func (p *PrometheusObserver) OnPluginUp(addr string, err error) {
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.pluginGrantPending = true
+	p.mu.Unlock()
+}
+
+func (p *PrometheusObserver) OnPluginDown(addr string, err error) {}
+
+func (p *PrometheusObserver) OnTLVSent(direction string, typ byte, length int) {
+	p.tlvBytes.WithLabelValues(direction, "sent").Observe(float64(length))
+
+	switch {
+	case direction == "tunnel" && typ == proxy_server.TunnelPingTLV:
+		p.mu.Lock()
+		p.pingSentAt = time.Now()
+		p.mu.Unlock()
+	case direction == "plugin" && typ == proxy_server.PluginWindowUpdateTLV:
+		if p.consumeGrantPending(&p.pluginGrantPending) {
+			return
+		}
+		p.pendingRequests.WithLabelValues(direction).Dec()
+	case direction == "tunnel" && typ == proxy_server.TunnelWindowUpdateTLV:
+		if p.consumeGrantPending(&p.tunnelGrantPending) {
+			return
+		}
+		p.pendingRequests.WithLabelValues(direction).Dec()
+	}
+}
+
+// consumeGrantPending reports whether *pending was set, clearing it
+// either way, so the initial window-size grant is only ever skipped
+// once per connection.
+func (p *PrometheusObserver) consumeGrantPending(pending *bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	was := *pending
+	*pending = false
+	return was
+}
+
+func (p *PrometheusObserver) OnTLVReceived(direction string, typ byte, length int) {
+	p.tlvBytes.WithLabelValues(direction, "received").Observe(float64(length))
+
+	if (direction == "plugin" && typ == proxy_server.PluginTaskTLV) ||
+		(direction == "tunnel" && typ == proxy_server.TunnelTaskTLV) {
+		p.pendingRequests.WithLabelValues(direction).Inc()
+	}
+
+	if direction == "tunnel" {
+		p.mu.Lock()
+		sentAt := p.pingSentAt
+		p.pingSentAt = time.Time{}
+		p.mu.Unlock()
+		if !sentAt.IsZero() {
+			p.pingRTT.Observe(time.Since(sentAt).Seconds())
+		}
+	}
+}
+
+func (p *PrometheusObserver) OnReconnectAttempt(n int, backoff time.Duration) {
+	p.reconnects.WithLabelValues("tunnel").Inc()
+}
+
+func (p *PrometheusObserver) OnPingTimeout() {}
+
+var _ proxy_server.Observer = (*PrometheusObserver)(nil)
@@ -0,0 +1,54 @@
+package proxy_server
+
+import "time"
+
+// Observer receives notifications about Server's connection lifecycle
+// and TLV traffic. Implementations must be safe for concurrent use, as
+// methods may be called from the plugin and tunnel goroutines
+// concurrently. A nil Observer is replaced by a no-op implementation.
+type Observer interface {
+	// OnTunnelUp/OnTunnelDown report the outcome of a tunnel connection
+	// attempt to endpoint; err is nil on OnTunnelUp.
+	OnTunnelUp(endpoint string, err error)
+	OnTunnelDown(endpoint string, err error)
+
+	// OnPluginUp/OnPluginDown report the outcome of a plugin connection
+	// attempt to addr; err is nil on OnPluginUp.
+	OnPluginUp(addr string, err error)
+	OnPluginDown(addr string, err error)
+
+	// OnTLVSent/OnTLVReceived report a TLV of the given type and payload
+	// length crossing the wire on the named connection ("plugin" or
+	// "tunnel").
+	OnTLVSent(direction string, typ byte, length int)
+	OnTLVReceived(direction string, typ byte, length int)
+
+	// OnReconnectAttempt reports that the previous tunnel reconnect attempt
+	// failed and that attempt n will be made after waiting backoff. The
+	// first attempt, made without a wait, is not reported.
+	OnReconnectAttempt(n int, backoff time.Duration)
+
+	// OnPingTimeout reports that checkTunnel gave up waiting for a
+	// response and is declaring the tunnel dead.
+	OnPingTimeout()
+}
+
+type noopObserver struct{}
+
+func (noopObserver) OnTunnelUp(string, error)             {}
+func (noopObserver) OnTunnelDown(string, error)           {}
+func (noopObserver) OnPluginUp(string, error)             {}
+func (noopObserver) OnPluginDown(string, error)           {}
+func (noopObserver) OnTLVSent(string, byte, int)          {}
+func (noopObserver) OnTLVReceived(string, byte, int)      {}
+func (noopObserver) OnReconnectAttempt(int, time.Duration) {}
+func (noopObserver) OnPingTimeout()                        {}
+
+var defaultObserver Observer = noopObserver{}
+
+func (s *Server) observer() Observer {
+	if s.Observer != nil {
+		return s.Observer
+	}
+	return defaultObserver
+}
@@ -0,0 +1,21 @@
+package proxy_server
+
+// ReqType identifies the kind of work item flowing through Server.reqs,
+// decoded from either the plugin or the tunnel TLV stream.
+type ReqType byte
+
+const (
+	CreateSSConnect ReqType = iota
+	PushTask
+	TaskResult
+	TunnelConnectOk
+	Ping
+	TypeEnd
+)
+
+// Request is the normalized representation of a TLV message once it has
+// been read off the plugin or tunnel connection.
+type Request struct {
+	Typ      ReqType
+	TaskData []byte
+}
@@ -0,0 +1,838 @@
+package proxy_server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Debug enables verbose logging of connection errors, reconnect attempts
+// and failed TLV writes.
+var Debug bool
+
+var (
+	// pollTimeout bounds how long a single read off the plugin or tunnel
+	// connection blocks before the poll loop rechecks for cancellation.
+	pollTimeout = 100 * time.Millisecond
+
+	// checkInterval and checkTimeout drive the tunnel liveness check: a
+	// Ping TLV is sent every checkInterval, and the tunnel is considered
+	// dead if no data has been received within checkTimeout.
+	checkInterval = 5 * time.Second
+	checkTimeout  = 30 * time.Second
+)
+
+var (
+	setupPluginErr   = errors.New("proxy_server: failed to setup plugin connection")
+	tunnelTimeoutErr = errors.New("proxy_server: tunnel connection timed out")
+)
+
+// RetryPolicy controls how handleTunnelErr retries a broken tunnel
+// connection before giving up and notifying the plugin.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxElapsed     time.Duration
+	MaxAttempts    int
+	Jitter         float64
+}
+
+// defaultRetryPolicy backs off from 100ms up to 30s, giving up after 10
+// attempts or 5 minutes, whichever comes first.
+var defaultRetryPolicy = RetryPolicy{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	MaxElapsed:     5 * time.Minute,
+	MaxAttempts:    10,
+	Jitter:         0.2,
+}
+
+// probeInterval controls how often down tunnel endpoints are re-probed
+// in the background so they can rejoin the healthy rotation.
+var probeInterval = 30 * time.Second
+
+// defaultWindowSize is the flow-control credit advertised to a peer when
+// Server.WindowSize is left unset.
+const defaultWindowSize = 64
+
+// endpointHealth tracks the liveness of a single tunnel endpoint.
+type endpointHealth struct {
+	lastSuccess      time.Time
+	consecutiveFails int
+}
+
+// ServerOption configures optional Server behavior at construction time.
+type ServerOption func(*Server)
+
+// WithPluginTLSConfig dials the plugin connection over TLS using cfg.
+// Server always dials out to pluginAddr, so it is the TLS client and cfg
+// is used as a client config (tls.Client); the plugin is the TLS server.
+func WithPluginTLSConfig(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.pluginTLSConfig = cfg
+	}
+}
+
+// WithTunnelTLSConfig dials the tunnel (control) connection over TLS
+// using cfg as the client config.
+func WithTunnelTLSConfig(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tunnelTLSConfig = cfg
+	}
+}
+
+// WithDataTLSConfig records cfg as the TLS client config for data
+// connections against dataAddr. Server itself never dials dataAddr, so
+// cfg is stored but not used by any connection.
+func WithDataTLSConfig(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.dataTLSConfig = cfg
+	}
+}
+
+// WithRetryPolicy overrides the default tunnel reconnect retry policy.
+func WithRetryPolicy(p RetryPolicy) ServerOption {
+	return func(s *Server) {
+		s.RetryPolicy = p
+	}
+}
+
+// WithObserver registers o to receive connection lifecycle and TLV
+// traffic notifications.
+func WithObserver(o Observer) ServerOption {
+	return func(s *Server) {
+		s.Observer = o
+	}
+}
+
+// Server bridges a local plugin connection and a remote tunnel
+// connection, translating TLV messages between them.
+type Server struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	pluginAddr string
+	tunnelAddr string
+	dataAddr   string
+
+	// tunnelEndpoints, when non-empty, makes setupTunnel choose among
+	// multiple candidate tunnel addresses instead of always dialing the
+	// static tunnelAddr; see selectEndpoint.
+	tunnelEndpoints []string
+	endpointMu      sync.Mutex
+	endpointHealth  map[string]*endpointHealth
+	endpointRR      int
+
+	// tunnelMu serializes setupTunnel and the tunnelConn/tunnelCtx/
+	// tunnelCancel/tunnelAddr mutations it performs, since both the
+	// background initial dial kicked off by newServer and
+	// handleTunnelErr's own reconnect loop can call it.
+	tunnelMu sync.Mutex
+
+	pluginTLSConfig *tls.Config
+	tunnelTLSConfig *tls.Config
+	dataTLSConfig   *tls.Config
+
+	pluginConn   net.Conn
+	pluginCtx    context.Context
+	pluginCancel context.CancelFunc
+	pluginWaiter sync.WaitGroup
+	pluginErr    chan error
+
+	tunnelConn   net.Conn
+	tunnelCtx    context.Context
+	tunnelCancel context.CancelFunc
+	tunnelWaiter sync.WaitGroup
+	tunnelErr    chan error
+
+	reqs chan *Request
+
+	lastRecvTime atomic.Value
+
+	// RetryPolicy governs how handleTunnelErr backs off between tunnel
+	// reconnect attempts.
+	RetryPolicy RetryPolicy
+
+	// WindowSize is the flow-control credit advertised to the plugin and
+	// tunnel peers on connect; defaultWindowSize is used when zero.
+	WindowSize int
+
+	// pluginWindow/tunnelWindow are the server's own receive credit: how
+	// many more pPushTask/tTask TLVs the plugin/tunnel may send before it
+	// must wait for a WindowUpdate. See replenishWindow.
+	pluginWindow int32
+	tunnelWindow int32
+
+	// pluginSendWindow/tunnelSendWindow are the send credit the plugin and
+	// tunnel peers have granted the server via their own WindowUpdate
+	// TLVs (see getPluginRequest/getCtrRequest); putPluginRequest and
+	// putCtrRequest refuse to write a forwarded task once it reaches
+	// zero, mirroring the accounting the server does on the receive side.
+	pluginSendWindow int32
+	tunnelSendWindow int32
+
+	// Observer, when set, is notified of connection lifecycle and TLV
+	// traffic events; see the Observer type.
+	Observer Observer
+}
+
+func (s *Server) windowSize() int {
+	if s.WindowSize > 0 {
+		return s.WindowSize
+	}
+	return defaultWindowSize
+}
+
+// NewServer creates a Server that will proxy between pluginAddr (the
+// local plugin control channel) and tunnelAddr/dataAddr (the remote
+// tunnel peer). The plugin connection is established synchronously; the
+// tunnel connection is established in the background and its failures
+// surface through Loop.
+func NewServer(pluginAddr, tunnelAddr, dataAddr string, opts ...ServerOption) (*Server, error) {
+	return newServer(pluginAddr, tunnelAddr, nil, dataAddr, opts...)
+}
+
+// NewServerWithEndpoints is like NewServer but accepts a list of
+// candidate tunnel endpoints instead of a single address. setupTunnel
+// prefers the healthiest endpoint (fewest consecutive failures, ties
+// broken round-robin), and endpoints that go down are re-probed
+// periodically in the background so they can rejoin the rotation.
+func NewServerWithEndpoints(pluginAddr string, tunnelEndpoints []string, dataAddr string, opts ...ServerOption) (*Server, error) {
+	return newServer(pluginAddr, "", tunnelEndpoints, dataAddr, opts...)
+}
+
+func newServer(pluginAddr, tunnelAddr string, tunnelEndpoints []string, dataAddr string, opts ...ServerOption) (*Server, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		ctx:             ctx,
+		cancel:          cancel,
+		pluginAddr:      pluginAddr,
+		tunnelAddr:      tunnelAddr,
+		tunnelEndpoints: tunnelEndpoints,
+		endpointHealth:  make(map[string]*endpointHealth, len(tunnelEndpoints)),
+		dataAddr:        dataAddr,
+		pluginErr:       make(chan error),
+		tunnelErr:       make(chan error),
+		reqs:            make(chan *Request),
+		RetryPolicy:     defaultRetryPolicy,
+	}
+	for _, ep := range tunnelEndpoints {
+		s.endpointHealth[ep] = &endpointHealth{}
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.lastRecvTime.Store(time.Now())
+
+	if pluginAddr != "" {
+		if err := s.setupPlugin(); err != nil {
+			cancel()
+			return nil, setupPluginErr
+		}
+	}
+
+	if tunnelAddr != "" || len(tunnelEndpoints) > 0 {
+		go func() {
+			if err := s.setupTunnel(); err != nil {
+				select {
+				case s.tunnelErr <- err:
+				case <-s.ctx.Done():
+				}
+			}
+		}()
+	}
+
+	if len(tunnelEndpoints) > 0 {
+		go s.probeEndpoints()
+	}
+
+	return s, nil
+}
+
+// selectEndpoint returns the tunnel address setupTunnel should dial
+// next: the least-failed configured endpoint, ties broken round-robin,
+// or the static tunnelAddr when no endpoint list was configured.
+func (s *Server) selectEndpoint() string {
+	s.endpointMu.Lock()
+	defer s.endpointMu.Unlock()
+
+	if len(s.tunnelEndpoints) == 0 {
+		return s.tunnelAddr
+	}
+
+	minFails := -1
+	for _, ep := range s.tunnelEndpoints {
+		if f := s.endpointHealth[ep].consecutiveFails; minFails == -1 || f < minFails {
+			minFails = f
+		}
+	}
+
+	var candidates []string
+	for _, ep := range s.tunnelEndpoints {
+		if s.endpointHealth[ep].consecutiveFails == minFails {
+			candidates = append(candidates, ep)
+		}
+	}
+
+	ep := candidates[s.endpointRR%len(candidates)]
+	s.endpointRR++
+	return ep
+}
+
+func (s *Server) markEndpointHealthy(ep string) {
+	s.endpointMu.Lock()
+	defer s.endpointMu.Unlock()
+	if h, ok := s.endpointHealth[ep]; ok {
+		h.lastSuccess = time.Now()
+		h.consecutiveFails = 0
+	}
+}
+
+func (s *Server) markEndpointUnhealthy(ep string) {
+	s.endpointMu.Lock()
+	defer s.endpointMu.Unlock()
+	if h, ok := s.endpointHealth[ep]; ok {
+		h.consecutiveFails++
+	}
+}
+
+// probeEndpoints periodically re-dials down endpoints with a lightweight
+// Ping so they can rejoin the healthy rotation without waiting for a
+// full reconnect cycle to stumble onto them.
+func (s *Server) probeEndpoints() {
+	ticker := time.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			for _, ep := range s.downEndpoints() {
+				s.probeEndpoint(ep)
+			}
+		}
+	}
+}
+
+func (s *Server) downEndpoints() []string {
+	s.endpointMu.Lock()
+	defer s.endpointMu.Unlock()
+	var down []string
+	for _, ep := range s.tunnelEndpoints {
+		if s.endpointHealth[ep].consecutiveFails > 0 {
+			down = append(down, ep)
+		}
+	}
+	return down
+}
+
+func (s *Server) probeEndpoint(ep string) {
+	conn, err := dialMaybeTLS(ep, s.tunnelTLSConfig)
+	if err != nil {
+		s.markEndpointUnhealthy(ep)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pollTimeout))
+	if err := WriteTLV(conn, TLV{T: tPing}); err != nil {
+		s.markEndpointUnhealthy(ep)
+		return
+	}
+	s.markEndpointHealthy(ep)
+}
+
+// dial is overridden in tests to substitute a fake dialer.
+var dial = func(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+func dialMaybeTLS(addr string, cfg *tls.Config) (net.Conn, error) {
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// writePluginTLV writes t to the plugin connection and, on success,
+// reports it to the configured Observer.
+func (s *Server) writePluginTLV(t TLV) error {
+	if err := WriteTLV(s.pluginConn, t); err != nil {
+		return err
+	}
+	s.observer().OnTLVSent("plugin", t.T, len(t.V))
+	return nil
+}
+
+// writeTunnelTLV writes t to the tunnel connection and, on success,
+// reports it to the configured Observer.
+func (s *Server) writeTunnelTLV(t TLV) error {
+	if err := WriteTLV(s.tunnelConn, t); err != nil {
+		return err
+	}
+	s.observer().OnTLVSent("tunnel", t.T, len(t.V))
+	return nil
+}
+
+func (s *Server) setupPlugin() error {
+	conn, err := dialMaybeTLS(s.pluginAddr, s.pluginTLSConfig)
+	if err != nil {
+		s.observer().OnPluginDown(s.pluginAddr, err)
+		return err
+	}
+	s.observer().OnPluginUp(s.pluginAddr, nil)
+	if s.pluginCancel != nil {
+		s.pluginCancel()
+	}
+	if s.pluginConn != nil {
+		s.pluginConn.Close()
+	}
+	s.pluginConn = conn
+	s.pluginCtx, s.pluginCancel = context.WithCancel(s.ctx)
+
+	atomic.StoreInt32(&s.pluginWindow, int32(s.windowSize()))
+	if err := s.writePluginTLV(encodeWindowUpdate(pWindowUpdate, uint32(s.windowSize()))); err != nil {
+		logf("failed to advertise plugin window: %v", err)
+	}
+	// Assume the plugin grants the server the same window it was just
+	// advertised, until a real pWindowUpdate from the plugin says
+	// otherwise (see getPluginRequest).
+	atomic.StoreInt32(&s.pluginSendWindow, int32(s.windowSize()))
+	return nil
+}
+
+// currentTunnelAddr returns the tunnel address last dialed (or
+// configured, before any dial has happened), synchronized with
+// setupTunnel's own mutation of the field.
+func (s *Server) currentTunnelAddr() string {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+	return s.tunnelAddr
+}
+
+func (s *Server) setupTunnel() error {
+	s.tunnelMu.Lock()
+	defer s.tunnelMu.Unlock()
+
+	endpoint := s.selectEndpoint()
+	conn, err := dialMaybeTLS(endpoint, s.tunnelTLSConfig)
+	if err != nil {
+		s.markEndpointUnhealthy(endpoint)
+		s.observer().OnTunnelDown(endpoint, err)
+		return err
+	}
+	s.markEndpointHealthy(endpoint)
+	s.observer().OnTunnelUp(endpoint, nil)
+	s.tunnelAddr = endpoint
+
+	if s.tunnelCancel != nil {
+		s.tunnelCancel()
+	}
+	if s.tunnelConn != nil {
+		s.tunnelConn.Close()
+	}
+	s.tunnelConn = conn
+	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
+
+	atomic.StoreInt32(&s.tunnelWindow, int32(s.windowSize()))
+	if err := s.writeTunnelTLV(encodeWindowUpdate(tWindowUpdate, uint32(s.windowSize()))); err != nil {
+		logf("failed to advertise tunnel window: %v", err)
+	}
+	// Assume the tunnel grants the server the same window it was just
+	// advertised, until a real tWindowUpdate from the tunnel says
+	// otherwise (see getCtrRequest).
+	atomic.StoreInt32(&s.tunnelSendWindow, int32(s.windowSize()))
+	return nil
+}
+
+// notifyTunnelReconnectFailed tells the plugin the tunnel is down for
+// good. The write goes out on its own goroutine because s.pluginConn is
+// typically an unbuffered pipe: the caller (handleTunnelErr, invoked
+// directly by Loop's own goroutine) has no concurrent reader standing by,
+// so a synchronous write here would block forever waiting for one.
+func (s *Server) notifyTunnelReconnectFailed() {
+	if s.pluginConn == nil {
+		return
+	}
+	go func() {
+		if err := s.writePluginTLV(TLV{T: pTunnelReconnectFailed}); err != nil {
+			logf("failed to notify plugin of tunnel reconnect failure: %v", err)
+		}
+	}()
+}
+
+// handleTunnelErr is invoked whenever the tunnel connection is reported
+// broken (triggerErr), either by Loop's tunnelErr channel or directly by
+// callers bootstrapping the initial connection. It retries setupTunnel
+// with exponential backoff and jitter per s.RetryPolicy and, once the
+// policy is exhausted, notifies the plugin via a pTunnelReconnectFailed
+// TLV.
+func (s *Server) handleTunnelErr(triggerErr error) error {
+	logf("tunnel error: %v, reconnecting to %s", triggerErr, s.currentTunnelAddr())
+	if s.currentTunnelAddr() == "" && len(s.tunnelEndpoints) == 0 {
+		return nil
+	}
+
+	policy := s.RetryPolicy
+	backoff := policy.InitialBackoff
+	start := time.Now()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = s.setupTunnel()
+		if err == nil {
+			return nil
+		}
+		logf("tunnel reconnect attempt %d failed: %v", attempt, err)
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			break
+		}
+		if policy.MaxElapsed > 0 && time.Since(start) >= policy.MaxElapsed {
+			break
+		}
+
+		sleep := withJitter(backoff, policy.Jitter)
+		logf("retrying tunnel setup in %s", sleep)
+		s.observer().OnReconnectAttempt(attempt+1, sleep)
+		select {
+		case <-time.After(sleep):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+
+	s.notifyTunnelReconnectFailed()
+	return err
+}
+
+// withJitter returns d adjusted by a uniformly random amount within
+// +/-jitter of d, e.g. withJitter(100ms, 0.2) returns a value in
+// [80ms, 120ms].
+func withJitter(d time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	delta := float64(d) * jitter
+	lo := float64(d) - delta
+	span := 2 * delta
+	return time.Duration(lo + rand.Float64()*span)
+}
+
+func (s *Server) getPluginRequest() (*Request, error) {
+	s.pluginConn.SetReadDeadline(time.Now().Add(pollTimeout))
+	t, err := ReadTLV(s.pluginConn)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+	s.observer().OnTLVReceived("plugin", t.T, len(t.V))
+	switch t.T {
+	case pPushTask:
+		atomic.AddInt32(&s.pluginWindow, -1)
+	case pWindowUpdate:
+		// the plugin is granting the server more credit to write task
+		// results back to it; see putPluginRequest.
+		atomic.AddInt32(&s.pluginSendWindow, int32(decodeWindowUpdate(t)))
+	}
+	return pluginTLVToRequest(t)
+}
+
+func (s *Server) getCtrRequest() (*Request, error) {
+	s.tunnelConn.SetReadDeadline(time.Now().Add(pollTimeout))
+	t, err := ReadTLV(s.tunnelConn)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// any successfully read TLV, including pure flow-control traffic,
+	// proves the tunnel is alive.
+	s.lastRecvTime.Store(time.Now())
+	s.observer().OnTLVReceived("tunnel", t.T, len(t.V))
+	switch t.T {
+	case tTask:
+		atomic.AddInt32(&s.tunnelWindow, -1)
+	case tWindowUpdate:
+		// the tunnel is granting the server more credit to write tasks
+		// to it; see putCtrRequest.
+		atomic.AddInt32(&s.tunnelSendWindow, int32(decodeWindowUpdate(t)))
+	}
+	return tunnelTLVToRequest(t)
+}
+
+func (s *Server) pollPlugin() {
+	defer s.pluginWaiter.Done()
+	for {
+		select {
+		case <-s.pluginCtx.Done():
+			return
+		default:
+		}
+
+		req, err := s.getPluginRequest()
+		if err != nil {
+			select {
+			case s.pluginErr <- err:
+			case <-s.pluginCtx.Done():
+			}
+			return
+		}
+		if req == nil {
+			continue
+		}
+
+		select {
+		case s.reqs <- req:
+		case <-s.pluginCtx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) pollTunnel() {
+	defer s.tunnelWaiter.Done()
+
+	select {
+	case s.reqs <- &Request{Typ: TunnelConnectOk}:
+	case <-s.tunnelCtx.Done():
+		return
+	}
+
+	for {
+		select {
+		case <-s.tunnelCtx.Done():
+			return
+		default:
+		}
+
+		req, err := s.getCtrRequest()
+		if err != nil {
+			select {
+			case s.tunnelErr <- err:
+			case <-s.tunnelCtx.Done():
+			}
+			return
+		}
+		if req == nil {
+			continue
+		}
+
+		select {
+		case s.reqs <- req:
+		case <-s.tunnelCtx.Done():
+			return
+		}
+	}
+}
+
+func (s *Server) checkTunnel() {
+	defer s.tunnelWaiter.Done()
+
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.tunnelCtx.Done():
+			return
+		case <-ticker.C:
+			if last, ok := s.lastRecvTime.Load().(time.Time); ok && time.Since(last) > checkTimeout {
+				s.observer().OnPingTimeout()
+				s.markEndpointUnhealthy(s.currentTunnelAddr())
+				select {
+				case s.tunnelErr <- tunnelTimeoutErr:
+				case <-s.tunnelCtx.Done():
+				}
+				return
+			}
+			if err := s.writeTunnelTLV(TLV{T: tPing}); err != nil {
+				select {
+				case s.tunnelErr <- err:
+				case <-s.tunnelCtx.Done():
+				}
+				return
+			}
+		}
+	}
+}
+
+// replenishWindow grants back one unit of flow-control credit after
+// handleRequest has drained req, notifying the originating peer via a
+// WindowUpdate TLV so it can resume sending. The write goes out on its
+// own goroutine for the same reason notifyTunnelReconnectFailed's does:
+// the caller is Loop's single dispatch goroutine, which has no
+// concurrent reader standing by, so a synchronous write here could block
+// forever.
+func (s *Server) replenishWindow(req *Request) {
+	switch req.Typ {
+	case PushTask:
+		atomic.AddInt32(&s.pluginWindow, 1)
+		if s.pluginConn == nil {
+			return
+		}
+		go func() {
+			if err := s.writePluginTLV(encodeWindowUpdate(pWindowUpdate, 1)); err != nil {
+				logf("failed to send plugin window update: %v", err)
+			}
+		}()
+	case TaskResult:
+		atomic.AddInt32(&s.tunnelWindow, 1)
+		if s.tunnelConn == nil {
+			return
+		}
+		go func() {
+			if err := s.writeTunnelTLV(encodeWindowUpdate(tWindowUpdate, 1)); err != nil {
+				logf("failed to send tunnel window update: %v", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) handleRequest(req *Request) error {
+	if req.Typ < CreateSSConnect || req.Typ >= TypeEnd {
+		return fmt.Errorf("unknown request type: %d", req.Typ)
+	}
+	switch req.Typ {
+	case CreateSSConnect:
+		// TODO: dial s.dataAddr and bridge the SOCKS connection for this task.
+	case PushTask:
+		go s.putCtrRequest(req)
+	case TaskResult:
+		go s.putPluginRequest(req)
+	case TunnelConnectOk, Ping:
+		// already delivered via reqs; nothing further to do.
+	}
+	return nil
+}
+
+// TunnelSendWindow reports how many more task TLVs the server may write
+// to the tunnel connection before putCtrRequest starts refusing, per the
+// credit the tunnel peer has granted via tWindowUpdate TLVs.
+func (s *Server) TunnelSendWindow() int32 {
+	return atomic.LoadInt32(&s.tunnelSendWindow)
+}
+
+// PluginSendWindow is TunnelSendWindow's counterpart for the plugin
+// connection; see putPluginRequest.
+func (s *Server) PluginSendWindow() int32 {
+	return atomic.LoadInt32(&s.pluginSendWindow)
+}
+
+// putCtrRequest forwards a task pushed by the plugin onward to the
+// tunnel peer, refusing to write beyond the send credit the tunnel has
+// granted (see getCtrRequest). It runs on its own goroutine for the same
+// reason notifyTunnelReconnectFailed's write does: the caller is Loop's
+// single dispatch goroutine, which has no concurrent reader standing by,
+// so a synchronous write here could block forever.
+func (s *Server) putCtrRequest(req *Request) {
+	if s.tunnelConn == nil {
+		return
+	}
+	if atomic.AddInt32(&s.tunnelSendWindow, -1) < 0 {
+		atomic.AddInt32(&s.tunnelSendWindow, 1)
+		logf("refusing to forward task to tunnel: no send credit remaining")
+		return
+	}
+	t := TLV{T: tTask, L: uint32(len(req.TaskData)), V: req.TaskData}
+	if err := s.writeTunnelTLV(t); err != nil {
+		logf("failed to forward task to tunnel: %v", err)
+	}
+}
+
+// putPluginRequest forwards a task result received from the tunnel back
+// to the plugin, refusing to write beyond the send credit the plugin has
+// granted (see getPluginRequest). It runs on its own goroutine for the
+// same reason putCtrRequest's does.
+func (s *Server) putPluginRequest(req *Request) {
+	if s.pluginConn == nil {
+		return
+	}
+	if atomic.AddInt32(&s.pluginSendWindow, -1) < 0 {
+		atomic.AddInt32(&s.pluginSendWindow, 1)
+		logf("refusing to forward task result to plugin: no send credit remaining")
+		return
+	}
+	t := TLV{T: pPushTask, L: uint32(len(req.TaskData)), V: req.TaskData}
+	if err := s.writePluginTLV(t); err != nil {
+		logf("failed to forward task result to plugin: %v", err)
+	}
+}
+
+// Loop establishes the tunnel connection and runs the poll/check loops
+// until the Server's context is canceled.
+func (s *Server) Loop() {
+	defer s.cancel()
+
+	if err := s.handleTunnelErr(errors.New("initial tunnel setup")); err != nil {
+		return
+	}
+
+	s.tunnelWaiter.Add(2)
+	go s.pollTunnel()
+	go s.checkTunnel()
+
+	if s.pluginConn != nil {
+		s.pluginWaiter.Add(1)
+		go s.pollPlugin()
+	}
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.tunnelWaiter.Wait()
+			s.pluginWaiter.Wait()
+			return
+		case err := <-s.tunnelErr:
+			if err := s.handleTunnelErr(err); err != nil {
+				return
+			}
+			s.tunnelWaiter.Add(2)
+			go s.pollTunnel()
+			go s.checkTunnel()
+		case err := <-s.pluginErr:
+			logf("plugin error: %v, reconnecting to %s", err, s.pluginAddr)
+			if err := s.setupPlugin(); err != nil {
+				return
+			}
+			s.pluginWaiter.Add(1)
+			go s.pollPlugin()
+		case req := <-s.reqs:
+			if err := s.handleRequest(req); err != nil {
+				logf("handle request %#v: %v", req, err)
+			}
+			s.replenishWindow(req)
+		}
+	}
+}
+
+func logf(format string, args ...interface{}) {
+	if Debug {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,62 @@
+package proxy_server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func acceptAndDiscard(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go io.Copy(io.Discard, conn)
+	}
+}
+
+func TestFailoverAcrossEndpoints(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	go acceptAndDiscard(l1)
+	go acceptAndDiscard(l2)
+
+	endpoints := []string{l1.Addr().String(), l2.Addr().String()}
+	s, err := NewServerWithEndpoints("", endpoints, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	// let the background initial connect land on l1.
+	time.Sleep(10 * time.Millisecond)
+	l1.Close()
+
+	r, w := net.Pipe()
+	s.pluginConn = w
+	defer r.Close()
+	s.RetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: len(endpoints) + 1}
+
+	if err := s.handleTunnelErr(tunnelTimeoutErr); err != nil {
+		t.Fatalf("expect transparent failover, but got error: %v", err)
+	}
+	if s.tunnelAddr != l2.Addr().String() {
+		t.Fatalf("expect failover to %s, but tunnel is on %s", l2.Addr().String(), s.tunnelAddr)
+	}
+
+	// the failover succeeded, so the plugin must never have been told to
+	// give up on the tunnel.
+	r.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := ReadTLV(r); err == nil {
+		t.Fatal("unexpected pTunnelReconnectFailed notification during transparent failover")
+	}
+}
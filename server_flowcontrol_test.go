@@ -0,0 +1,75 @@
+package proxy_server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPluginFlowControl(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	s.WindowSize = 2
+	s.pluginCtx, s.pluginCancel = context.WithCancel(s.ctx)
+
+	r, w := net.Pipe()
+	s.pluginConn = w
+	atomic.StoreInt32(&s.pluginWindow, int32(s.WindowSize))
+
+	// credit tracked by a fake sender, mirroring what the real plugin
+	// binary is expected to enforce on its side of the wire.
+	credit := int32(s.WindowSize)
+	send := func() bool {
+		if atomic.LoadInt32(&credit) <= 0 {
+			return false
+		}
+		atomic.AddInt32(&credit, -1)
+		if err := WriteTLV(r, TLV{T: pPushTask, L: 1, V: []byte{1}}); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	}
+
+	ret := make(chan struct{})
+	go func() {
+		s.pluginWaiter.Add(1)
+		s.pollPlugin()
+		ret <- struct{}{}
+	}()
+
+	for i := 0; i < s.WindowSize; i++ {
+		if !send() {
+			t.Fatalf("sender ran out of credit too early at task %d", i)
+		}
+		<-s.reqs
+	}
+	if send() {
+		t.Fatal("sender should have exhausted its credit")
+	}
+
+	// the server drains one request and grants credit back.
+	s.replenishWindow(&Request{Typ: PushTask})
+
+	upd, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upd.T != pWindowUpdate {
+		t.Fatalf("expect a pWindowUpdate TLV, but got %#v", upd)
+	}
+	atomic.AddInt32(&credit, int32(binary.BigEndian.Uint32(upd.V)))
+
+	if !send() {
+		t.Fatal("sender should resume sending after the window update")
+	}
+	<-s.reqs
+
+	s.pluginCancel()
+	<-ret
+}
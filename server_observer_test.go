@@ -0,0 +1,130 @@
+package proxy_server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockObserver records every event it receives, in call order, behind a
+// mutex so it is safe to read once the exercised goroutines have
+// finished.
+type mockObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (m *mockObserver) record(e string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+}
+
+func (m *mockObserver) snapshot() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]string, len(m.events))
+	copy(out, m.events)
+	return out
+}
+
+func (m *mockObserver) OnTunnelUp(endpoint string, err error) {
+	if err == nil {
+		m.record("tunnel-up:" + endpoint)
+	} else {
+		m.record("tunnel-down:" + endpoint)
+	}
+}
+func (m *mockObserver) OnTunnelDown(endpoint string, err error) { m.record("tunnel-down:" + endpoint) }
+func (m *mockObserver) OnPluginUp(addr string, err error)       { m.record("plugin-up:" + addr) }
+func (m *mockObserver) OnPluginDown(addr string, err error)     { m.record("plugin-down:" + addr) }
+func (m *mockObserver) OnTLVSent(direction string, typ byte, length int) {
+	m.record("sent:" + direction)
+}
+func (m *mockObserver) OnTLVReceived(direction string, typ byte, length int) {
+	m.record("received:" + direction)
+}
+func (m *mockObserver) OnReconnectAttempt(n int, backoff time.Duration) {
+	m.record("reconnect-attempt")
+}
+func (m *mockObserver) OnPingTimeout() { m.record("ping-timeout") }
+
+func TestHandleTunnelErrObserverEvents(t *testing.T) {
+	obs := &mockObserver{}
+	s, err := NewServer("", "", "", WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	r, w := net.Pipe()
+	defer r.Close()
+	s.pluginConn = w
+	s.tunnelAddr = "127.0.0.1:1"
+	s.RetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxAttempts: 3}
+
+	if err := s.handleTunnelErr(tunnelTimeoutErr); err == nil {
+		t.Fatal("expected the reconnect to fail")
+	}
+
+	events := obs.snapshot()
+	wantPrefix := []string{"tunnel-down:127.0.0.1:1", "reconnect-attempt", "tunnel-down:127.0.0.1:1"}
+	if len(events) < len(wantPrefix) {
+		t.Fatalf("expect at least %d events, got %v", len(wantPrefix), events)
+	}
+	for i, want := range wantPrefix {
+		if events[i] != want {
+			t.Fatalf("event %d: expect %q, got %q (all events: %v)", i, want, events[i], events)
+		}
+	}
+}
+
+func TestCheckTunnelObserverPingTimeout(t *testing.T) {
+	obs := &mockObserver{}
+	s, err := NewServer("", "", "", WithObserver(obs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	r, w := net.Pipe()
+	defer w.Close()
+	s.tunnelConn = r
+	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
+
+	checkInterval = time.Millisecond
+	checkTimeout = 2 * time.Millisecond
+
+	ret := make(chan struct{})
+	go func() {
+		s.tunnelWaiter.Add(1)
+		s.checkTunnel()
+		ret <- struct{}{}
+	}()
+
+	go func() {
+		for {
+			if _, err := ReadTLV(w); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := <-s.tunnelErr; err != tunnelTimeoutErr {
+		t.Fatalf("expect timeout, but got %v", err)
+	}
+	<-ret
+
+	found := false
+	for _, e := range obs.snapshot() {
+		if e == "ping-timeout" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("expect a ping-timeout event, got %v", obs.snapshot())
+	}
+}
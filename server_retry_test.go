@@ -0,0 +1,85 @@
+package proxy_server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleTunnelErrBackoffSchedule(t *testing.T) {
+	origDial := dial
+	defer func() { dial = origDial }()
+
+	dialErr := errors.New("connection refused")
+	var attemptTimes []time.Time
+	dial = func(network, addr string) (net.Conn, error) {
+		attemptTimes = append(attemptTimes, time.Now())
+		return nil, dialErr
+	}
+
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	s.tunnelAddr = "fake:1"
+	s.RetryPolicy = RetryPolicy{
+		InitialBackoff: 5 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		MaxAttempts:    4,
+	}
+
+	if err := s.handleTunnelErr(dialErr); err != dialErr {
+		t.Fatalf("expect %v, but got %v", dialErr, err)
+	}
+	if len(attemptTimes) != 4 {
+		t.Fatalf("expect 4 attempts, but got %d", len(attemptTimes))
+	}
+
+	wantBackoff := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}
+	for i, want := range wantBackoff {
+		got := attemptTimes[i+1].Sub(attemptTimes[i])
+		if got < want {
+			t.Errorf("attempt %d: expect delay >= %s, but got %s", i+1, want, got)
+		}
+	}
+}
+
+func TestHandleTunnelErrContextCancelAbortsRetry(t *testing.T) {
+	origDial := dial
+	defer func() { dial = origDial }()
+
+	dialErr := errors.New("connection refused")
+	dial = func(network, addr string) (net.Conn, error) {
+		return nil, dialErr
+	}
+
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.tunnelAddr = "fake:1"
+	s.RetryPolicy = RetryPolicy{
+		InitialBackoff: time.Hour,
+		MaxAttempts:    10,
+	}
+
+	ret := make(chan error, 1)
+	go func() { ret <- s.handleTunnelErr(dialErr) }()
+
+	time.Sleep(5 * time.Millisecond)
+	s.cancel()
+
+	select {
+	case err := <-ret:
+		if err != context.Canceled {
+			t.Fatalf("expect context.Canceled, but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handleTunnelErr did not abort promptly after cancellation")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -175,7 +176,6 @@ func TestCheckTunnel(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	<-s.tunnelErr
 	defer s.cancel()
 
 	r, w := net.Pipe()
@@ -235,11 +235,22 @@ func TestHandleTunnelErr(t *testing.T) {
 		t.Fatalf("got unexpected error: %v", err)
 	}
 
-	go s.Loop()
-	// mock a failed reconnection
+	// mock a failed reconnection. Set every field Loop's own goroutine
+	// will read before starting it: Loop calls handleTunnelErr itself on
+	// startup, and that racing against this test's own mutation of
+	// s.tunnelAddr/s.RetryPolicy/s.pluginConn is exactly the kind of
+	// unsynchronized access the race detector (rightly) flags.
 	r, w := net.Pipe()
 	s.pluginConn = w
 	s.tunnelAddr = "127.0.0.1:1"
+	s.RetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 1}
+
+	done := make(chan struct{})
+	go func() {
+		s.Loop()
+		close(done)
+	}()
+
 	err = s.handleTunnelErr(tunnelTimeoutErr)
 	if err == nil {
 		t.Fatal("not get expected error")
@@ -252,6 +263,49 @@ func TestHandleTunnelErr(t *testing.T) {
 	if !reflect.DeepEqual(got, expect) {
 		t.Fatalf("expect %#v, but got %#v", expect, got)
 	}
+
+	// Loop's own initial handleTunnelErr call is racing the one above on
+	// the same Server; with MaxAttempts: 1 it gives up immediately, so
+	// Loop returns right away. Wait for it so it can't outlive this test
+	// and race a later one's access to shared state (e.g. the global
+	// Debug var in TestReSetup).
+	s.cancel()
+	<-done
+}
+
+func TestNotifyTunnelReconnectFailedDoesNotBlock(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	r, w := net.Pipe()
+	s.pluginConn = w
+
+	// No one is reading from r yet, so this must not block: a caller on
+	// an unbuffered net.Pipe with no concurrent reader standing by would
+	// otherwise hang forever, as handleTunnelErr's own callers do.
+	done := make(chan struct{})
+	go func() {
+		s.notifyTunnelReconnectFailed()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("notifyTunnelReconnectFailed blocked with no plugin reader present")
+	}
+
+	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
 }
 
 func TestSetupTunnelFailureFirstTime(t *testing.T) {
@@ -266,6 +320,7 @@ func TestSetupTunnelFailureFirstTime(t *testing.T) {
 
 	// mock a failed setup
 	s.tunnelAddr = "127.0.0.1:1"
+	s.RetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 1}
 	go s.Loop()
 
 	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
@@ -284,23 +339,145 @@ func TestHandleRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer s.cancel()
-	conn, _ := net.Pipe()
-	s.pluginConn = conn
-	s.tunnelConn = conn
+
+	// PushTask and TaskResult now trigger an async forwarding write (see
+	// putCtrRequest/putPluginRequest); read those off explicitly so their
+	// background goroutines finish before the test returns.
+	pluginR, pluginW := net.Pipe()
+	defer pluginR.Close()
+	s.pluginConn = pluginW
+
+	tunnelR, tunnelW := net.Pipe()
+	defer tunnelR.Close()
+	s.tunnelConn = tunnelW
+
+	// bypassing setupPlugin/setupTunnel skips the send-window seeding
+	// they normally do; grant enough credit by hand for both forwards
+	// below to go through.
+	atomic.StoreInt32(&s.pluginSendWindow, 1)
+	atomic.StoreInt32(&s.tunnelSendWindow, 1)
 
 	for i := CreateSSConnect; i < TypeEnd; i++ {
 		i := i
 		t.Run(fmt.Sprintf("type-%d", int(i)), func(t *testing.T) {
-			t.Parallel()
-
 			err := s.handleRequest(&Request{Typ: i})
 			if err != nil {
 				t.Error(err)
 			}
+			switch i {
+			case PushTask:
+				if _, err := ReadTLV(tunnelR); err != nil {
+					t.Error(err)
+				}
+			case TaskResult:
+				if _, err := ReadTLV(pluginR); err != nil {
+					t.Error(err)
+				}
+			}
 		})
 	}
 }
 
+func TestHandleRequestForwardsTraffic(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	pluginR, pluginW := net.Pipe()
+	defer pluginR.Close()
+	s.pluginConn = pluginW
+
+	tunnelR, tunnelW := net.Pipe()
+	defer tunnelR.Close()
+	s.tunnelConn = tunnelW
+
+	atomic.StoreInt32(&s.pluginSendWindow, 1)
+	atomic.StoreInt32(&s.tunnelSendWindow, 1)
+
+	t.Run("pushTaskGoesToTunnel", func(t *testing.T) {
+		if err := s.handleRequest(&Request{Typ: PushTask, TaskData: []byte("hi")}); err != nil {
+			t.Fatal(err)
+		}
+		expect := TLV{T: tTask, L: 2, V: []byte("hi")}
+		got, err := ReadTLV(tunnelR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+	})
+
+	t.Run("taskResultGoesToPlugin", func(t *testing.T) {
+		if err := s.handleRequest(&Request{Typ: TaskResult, TaskData: []byte("bye")}); err != nil {
+			t.Fatal(err)
+		}
+		expect := TLV{T: pPushTask, L: 3, V: []byte("bye")}
+		got, err := ReadTLV(pluginR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("expect %#v, but got %#v", expect, got)
+		}
+	})
+}
+
+func TestPutRequestRefusesBeyondSendWindow(t *testing.T) {
+	s, err := NewServer("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	tunnelR, tunnelW := net.Pipe()
+	defer tunnelR.Close()
+	s.tunnelConn = tunnelW
+
+	// no credit granted: putCtrRequest must refuse to write rather than
+	// block forever or exceed what the tunnel peer has allowed.
+	done := make(chan struct{})
+	go func() {
+		s.putCtrRequest(&Request{Typ: PushTask, TaskData: []byte("x")})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("putCtrRequest blocked instead of refusing with no send credit")
+	}
+	if got := s.TunnelSendWindow(); got != 0 {
+		t.Fatalf("expect send window to stay at 0, got %d", got)
+	}
+
+	// granting credit via a real tWindowUpdate TLV lets the next forward
+	// through.
+	s.tunnelCtx, s.tunnelCancel = context.WithCancel(s.ctx)
+	go func() {
+		if err := WriteTLV(tunnelR, encodeWindowUpdate(tWindowUpdate, 1)); err != nil {
+			t.Error(err)
+		}
+	}()
+	if _, err := s.getCtrRequest(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.TunnelSendWindow(); got != 1 {
+		t.Fatalf("expect send window 1 after WindowUpdate, got %d", got)
+	}
+
+	go s.putCtrRequest(&Request{Typ: PushTask, TaskData: []byte("x")})
+	expect := TLV{T: tTask, L: 1, V: []byte("x")}
+	got, err := ReadTLV(tunnelR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+}
+
 func TestGetRequestTimeout(t *testing.T) {
 	ts := httptest.NewServer(nil)
 	defer ts.Close()
@@ -0,0 +1,183 @@
+package proxy_server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTLSEchoListener starts a TLS listener, self-signed for 127.0.0.1,
+// that echoes back every TLV it reads on each accepted connection. It
+// lets tests dial it with dialMaybeTLS and then confirm the TLV codec
+// (see tlv.go) round-trips correctly once wrapped in tls.Client/tls.Server,
+// the same way TestPollTunnel exercises it over a plain net.Pipe.
+func newTLSEchoListener(t *testing.T) (net.Listener, *tls.Config) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					tlv, err := ReadTLV(c)
+					if err != nil {
+						return
+					}
+					if err := WriteTLV(c, tlv); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return ln, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+func TestReSetupTLS(t *testing.T) {
+	Debug = true
+	ln, cfg := newTLSEchoListener(t)
+	addr := ln.Addr().String()
+
+	s, err := NewServer("", "", "", WithTunnelTLSConfig(cfg), WithPluginTLSConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	s.tunnelAddr = addr
+	s.pluginAddr = addr
+
+	pollTimeout = 1 * time.Millisecond
+	for name, f := range map[string]func(*testing.T){
+		"tunnel": func(t *testing.T) {
+			if err := s.setupTunnel(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+			if err := s.setupTunnel(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the TLV protocol must still work once the connection is
+			// wrapped in TLS. Drain the window advertisement setupTunnel
+			// itself just sent and the listener echoed back, then confirm
+			// our own TLV round-trips.
+			s.tunnelConn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := ReadTLV(s.tunnelConn); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.writeTunnelTLV(TLV{T: tTask, L: 1, V: []byte{9}}); err != nil {
+				t.Fatal(err)
+			}
+			expect := TLV{T: tTask, L: 1, V: []byte{9}}
+			got, err := ReadTLV(s.tunnelConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expect) {
+				t.Fatalf("expect %#v, but got %#v", expect, got)
+			}
+		},
+		"plugin": func(t *testing.T) {
+			if err := s.setupPlugin(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(2 * time.Millisecond)
+			if err := s.setupPlugin(); err != nil {
+				t.Fatal(err)
+			}
+
+			s.pluginConn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := ReadTLV(s.pluginConn); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.writePluginTLV(TLV{T: pPushTask, L: 1, V: []byte{9}}); err != nil {
+				t.Fatal(err)
+			}
+			expect := TLV{T: pPushTask, L: 1, V: []byte{9}}
+			got, err := ReadTLV(s.pluginConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expect) {
+				t.Fatalf("expect %#v, but got %#v", expect, got)
+			}
+		},
+	} {
+		t.Run(name, f)
+	}
+}
+
+func TestHandleTunnelErrTLSHandshakeFailure(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	// An empty pool means the server's certificate can never be
+	// verified, so the handshake performed during reconnection fails.
+	cfg := &tls.Config{RootCAs: x509.NewCertPool(), ServerName: "127.0.0.1"}
+
+	s, err := NewServer("", "", "", WithTunnelTLSConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.cancel()
+
+	r, w := net.Pipe()
+	s.pluginConn = w
+	s.tunnelAddr = ts.Listener.Addr().String()
+	s.RetryPolicy = RetryPolicy{InitialBackoff: time.Millisecond, MaxAttempts: 1}
+
+	if err := s.handleTunnelErr(tunnelTimeoutErr); err == nil {
+		t.Fatal("expected a TLS handshake error, got nil")
+	}
+
+	expect := TLV{T: pTunnelReconnectFailed, L: 0, V: []byte{}}
+	got, err := ReadTLV(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("expect %#v, but got %#v", expect, got)
+	}
+}
@@ -0,0 +1,126 @@
+package proxy_server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// TLV types exchanged between the server and the local plugin.
+const (
+	pPushTask byte = iota
+	pTunnelReconnectFailed
+	pWindowUpdate
+)
+
+// TLV types exchanged between the server and the remote tunnel peer.
+const (
+	tTask byte = iota
+	tPing
+	tWindowUpdate
+)
+
+// Exported aliases of the wire-level TLV type bytes above, for Observer
+// implementations outside this package (see observer.go) that need to
+// tell real task/keepalive traffic apart from flow-control bookkeeping.
+const (
+	PluginTaskTLV         = pPushTask
+	PluginWindowUpdateTLV = pWindowUpdate
+	TunnelTaskTLV         = tTask
+	TunnelPingTLV         = tPing
+	TunnelWindowUpdateTLV = tWindowUpdate
+)
+
+// TLV is the wire format shared by the plugin and tunnel connections: a
+// 1-byte type, a 4-byte big-endian length and the raw payload.
+type TLV struct {
+	T byte
+	L uint32
+	V []byte
+}
+
+// WriteTLV serializes t onto w.
+func WriteTLV(w io.Writer, t TLV) error {
+	header := make([]byte, 5)
+	header[0] = t.T
+	binary.BigEndian.PutUint32(header[1:], t.L)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if t.L == 0 {
+		return nil
+	}
+	_, err := w.Write(t.V)
+	return err
+}
+
+// ReadTLV reads a single TLV off r.
+func ReadTLV(r io.Reader) (TLV, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return TLV{}, err
+	}
+	t := TLV{T: header[0], L: binary.BigEndian.Uint32(header[1:])}
+	if t.L == 0 {
+		t.V = []byte{}
+		return t, nil
+	}
+	t.V = make([]byte, t.L)
+	if _, err := io.ReadFull(r, t.V); err != nil {
+		return TLV{}, err
+	}
+	return t, nil
+}
+
+func pluginTLVToRequest(t TLV) (*Request, error) {
+	switch t.T {
+	case pPushTask:
+		return &Request{Typ: PushTask, TaskData: t.V}, nil
+	case pWindowUpdate:
+		// no Request: getPluginRequest has already added the credit it
+		// carries to pluginSendWindow.
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown plugin TLV type: %d", t.T)
+	}
+}
+
+func tunnelTLVToRequest(t TLV) (*Request, error) {
+	switch t.T {
+	case tTask:
+		return &Request{Typ: TaskResult, TaskData: t.V}, nil
+	case tPing:
+		return &Request{Typ: Ping}, nil
+	case tWindowUpdate:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown tunnel TLV type: %d", t.T)
+	}
+}
+
+// encodeWindowUpdate builds the TLV a WindowUpdate delta is carried in.
+func encodeWindowUpdate(t byte, delta uint32) TLV {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, delta)
+	return TLV{T: t, L: 4, V: v}
+}
+
+// decodeWindowUpdate reads the delta out of a WindowUpdate TLV encoded
+// by encodeWindowUpdate.
+func decodeWindowUpdate(t TLV) uint32 {
+	if len(t.V) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(t.V)
+}
+
+// GetCtrRequest reads one TLV off r and decodes it as a control-channel
+// (tunnel) request. It is exported so the tunnel peer side can decode
+// what the server writes to it (e.g. in tests).
+func GetCtrRequest(r io.Reader) (*Request, error) {
+	t, err := ReadTLV(r)
+	if err != nil {
+		return nil, err
+	}
+	return tunnelTLVToRequest(t)
+}